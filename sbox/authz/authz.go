@@ -0,0 +1,39 @@
+// Package authz holds the capability restrictions sbox enforces on every
+// process it creates, regardless of the entry point (the initial process in
+// Run, or a later process exec'd through the control socket), so the two
+// can't drift out of sync with each other.
+package authz
+
+import (
+	"fmt"
+
+	"gvisor.googlesource.com/gvisor/pkg/abi/linux"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/kernel/auth"
+)
+
+// ReservedCapabilities may not be granted to any sbox process: they would
+// let it affect the host kernel or other sandboxes, which sbox does not
+// support regardless of what the sentry itself enforces.
+var ReservedCapabilities = []linux.Capability{
+	linux.CAP_SYS_MODULE,
+	linux.CAP_SYS_BOOT,
+	linux.CAP_SYS_TIME,
+	linux.CAP_SYS_RAWIO,
+	linux.CAP_MAC_ADMIN,
+	linux.CAP_MAC_OVERRIDE,
+}
+
+// ValidateCapabilities rejects any capability set that includes one of
+// ReservedCapabilities.
+func ValidateCapabilities(caps *auth.TaskCapabilities) error {
+	if caps == nil {
+		return nil
+	}
+	all := caps.PermittedCaps | caps.InheritableCaps | caps.EffectiveCaps | caps.BoundingCaps | caps.AmbientCaps
+	for _, c := range ReservedCapabilities {
+		if all&auth.CapabilitySetOf(c) != 0 {
+			return fmt.Errorf("capability %s is not permitted", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Client talks to a running Server over its control socket, so a second
+// sbox invocation can act against an already-running sandbox (e.g.
+// `sbox exec <id> -- cmd args...`).
+type Client struct {
+	conn *net.UnixConn
+}
+
+// Dial connects to the control socket at path.
+func Dial(path string) (*Client, error) {
+	addr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving control socket address: %v", err)
+	}
+	conn, err := net.DialUnix("unix", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing control socket: %v", err)
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the connection to the control socket.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) call(method string, params interface{}, files []*os.File, result interface{}) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if err := writeRequest(c.conn, request{Method: method, Params: raw}, files); err != nil {
+		return err
+	}
+	resp, err := readResponse(c.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s: %s", method, resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	b, err := json.Marshal(resp.Result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, result)
+}
+
+// Exec runs a new process inside the sandbox with the given stdio files and
+// returns its PID.
+func (c *Client) Exec(args ExecArgs, stdin, stdout, stderr *os.File) (int32, error) {
+	var pid int32
+	err := c.call("Exec", args, []*os.File{stdin, stdout, stderr}, &pid)
+	return pid, err
+}
+
+// Signal delivers a signal to a process or process group in the sandbox.
+func (c *Client) Signal(sig Signal) error {
+	return c.call("Signal", sig, nil, nil)
+}
+
+// Wait blocks until pid exits inside the sandbox and returns its exit
+// status.
+func (c *Client) Wait(pid int32) (int32, error) {
+	var status int32
+	err := c.call("Wait", pid, nil, &status)
+	return status, err
+}
+
+// Processes lists the processes currently running inside the sandbox.
+func (c *Client) Processes() ([]ProcessInfo, error) {
+	var procs []ProcessInfo
+	err := c.call("Processes", struct{}{}, nil, &procs)
+	return procs, err
+}
@@ -0,0 +1,405 @@
+// Package control implements a small control plane for a running sbox
+// sandbox, analogous to gVisor's runsc/boot/controller.go and
+// pkg/sentry/control. A Server listens on a Unix domain socket and accepts
+// JSON-RPC requests to exec new processes, signal or wait on existing ones,
+// and list the processes running inside the sandbox.
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/tiborvass/vzor/sbox/authz"
+	"gvisor.googlesource.com/gvisor/pkg/abi/linux"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/context"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/fs"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/fs/host"
+	hostvfs2 "gvisor.googlesource.com/gvisor/pkg/sentry/fsimpl/host"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/kdefs"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/kernel"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/limits"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/vfs"
+)
+
+// request is the wire format for a single command sent to the control
+// socket: a method name plus its JSON-encoded parameters.
+type request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type response struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// ExecArgs mirrors gVisor's control.ExecArgs: everything needed to start a
+// new process inside an already-running sandbox.
+type ExecArgs struct {
+	Argv         []string
+	Envv         []string
+	Cwd          string
+	KUID         uint32
+	KGID         uint32
+	Capabilities *auth.TaskCapabilities
+	// StdioIsPty indicates that FDs 0-2 are a single PTY master shared
+	// across stdin/stdout/stderr, as with the initial process's TTY.
+	StdioIsPty bool
+}
+
+// Signal targets either a single PID or, when ForegroundProcessGroup is set,
+// the foreground process group of the container's controlling TTY.
+type Signal struct {
+	PID                    int32
+	Signo                  int32
+	ForegroundProcessGroup bool
+}
+
+// ProcessInfo describes one thread group running inside the sandbox, for
+// the Processes command.
+type ProcessInfo struct {
+	PID   int32
+	PPID  int32
+	State string
+}
+
+// Server is a control socket bound to a single running sandbox kernel.
+// Exactly one of (mns) or (vfsObj, mntns, root) is set, matching whichever
+// of VFS1/VFS2 the sandbox was started with.
+type Server struct {
+	k      *kernel.Kernel
+	mns    *fs.MountNamespace
+	vfsObj *vfs.VirtualFilesystem
+	mntns  *vfs.MountNamespace
+	root   *vfs.VirtualDentry
+	path   string
+
+	mu sync.Mutex
+	ln *net.UnixListener
+}
+
+// New returns a Server that will, once Serve is called, accept commands
+// against k over a Unix socket at path. mns is the sandbox's VFS1 root
+// mount namespace, shared by every exec'd process; it is nil for a VFS2
+// sandbox, which instead shares vfsObj, mntns and root.
+func New(k *kernel.Kernel, mns *fs.MountNamespace, vfsObj *vfs.VirtualFilesystem, mntns *vfs.MountNamespace, root *vfs.VirtualDentry, path string) *Server {
+	return &Server{k: k, mns: mns, vfsObj: vfsObj, mntns: mntns, root: root, path: path}
+}
+
+// Serve listens on the control socket and handles connections until the
+// listener is closed. It is meant to be run in its own goroutine.
+func (s *Server) Serve() error {
+	os.Remove(s.path)
+	addr, err := net.ResolveUnixAddr("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("error resolving control socket address: %v", err)
+	}
+	ln, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on control socket: %v", err)
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close shuts down the control socket.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *Server) handle(conn *net.UnixConn) {
+	defer conn.Close()
+
+	for {
+		req, files, err := readRequest(conn)
+		if err != nil {
+			return
+		}
+
+		var resp response
+		result, err := s.dispatchRecover(req, files)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result = result
+		}
+		if err := writeResponse(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// dispatchRecover runs dispatch, converting a panic into an error response
+// instead of letting it unwind past handle's goroutine and take the whole
+// sbox process (and the sandboxed workload with it) down.
+func (s *Server) dispatchRecover(req request, files []*os.File) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic handling %q: %v", req.Method, r)
+		}
+	}()
+	return s.dispatch(req, files)
+}
+
+func (s *Server) dispatch(req request, files []*os.File) (interface{}, error) {
+	switch req.Method {
+	case "Exec":
+		var args ExecArgs
+		if err := json.Unmarshal(req.Params, &args); err != nil {
+			return nil, err
+		}
+		return s.Exec(args, files)
+	case "Signal":
+		var sig Signal
+		if err := json.Unmarshal(req.Params, &sig); err != nil {
+			return nil, err
+		}
+		return nil, s.Signal(sig)
+	case "Wait":
+		var pid int32
+		if err := json.Unmarshal(req.Params, &pid); err != nil {
+			return nil, err
+		}
+		return s.Wait(pid)
+	case "Processes":
+		return s.Processes()
+	default:
+		return nil, fmt.Errorf("unknown method %q", req.Method)
+	}
+}
+
+// Exec starts a new process inside the sandbox sharing its root mount
+// namespace (VFS1) or mount namespace and root (VFS2), importing files
+// (stdin, stdout, stderr, in order) as the new process's stdio.
+func (s *Server) Exec(args ExecArgs, files []*os.File) (int32, error) {
+	if len(files) != 3 {
+		return 0, fmt.Errorf("exec requires exactly 3 stdio FDs, got %d", len(files))
+	}
+
+	caps := args.Capabilities
+	if err := authz.ValidateCapabilities(caps); err != nil {
+		return 0, err
+	}
+	creds := auth.NewUserCredentials(
+		auth.KUID(args.KUID),
+		auth.KGID(args.KGID),
+		nil,
+		caps,
+		s.k.RootUserNamespace())
+
+	ls, err := limits.NewLinuxLimitSet()
+	if err != nil {
+		return 0, err
+	}
+
+	cwd := args.Cwd
+	if cwd == "" {
+		cwd = "/"
+	}
+	procArgs := kernel.CreateProcessArgs{
+		Argv:                    args.Argv,
+		Envv:                    args.Envv,
+		WorkingDirectory:        cwd,
+		Credentials:             creds,
+		Umask:                   0022,
+		Limits:                  ls,
+		MaxSymlinkTraversals:    linux.MaxSymlinkTraversals,
+		UTSNamespace:            s.k.RootUTSNamespace(),
+		IPCNamespace:            s.k.RootIPCNamespace(),
+		AbstractSocketNamespace: s.k.RootAbstractSocketNamespace(),
+		ContainerID:             "sbox",
+	}
+
+	if s.k.VFS2Enabled() {
+		if s.vfsObj == nil || s.mntns == nil || s.root == nil {
+			return 0, fmt.Errorf("exec: VFS2 sandbox has no root to exec against")
+		}
+		procArgs.MountNamespaceVFS2 = s.mntns
+		procArgs.RootVFS2 = *s.root
+		procArgs.WorkingDirectoryVFS2 = *s.root
+		ctx := procArgs.NewContext(s.k)
+
+		fdTable, tty, err := importStdioVFS2(ctx, s.k, s.vfsObj, ls, args.StdioIsPty, creds, files)
+		if err != nil {
+			return 0, fmt.Errorf("error importing exec fds: %v", err)
+		}
+		procArgs.FDTable = fdTable
+
+		tg, _, err := s.k.CreateProcess(procArgs)
+		if err != nil {
+			return 0, fmt.Errorf("failed to exec process: %v", err)
+		}
+		if args.StdioIsPty && tty != nil {
+			tty.InitForegroundProcessGroup(tg.ProcessGroup())
+		}
+		return int32(tg.Leader().ID()), nil
+	}
+
+	procArgs.MountNamespace = s.mns
+	ctx := procArgs.NewContext(s.k)
+
+	fdm, tty, err := importStdio(ctx, s.k, ls, args.StdioIsPty, files)
+	if err != nil {
+		return 0, fmt.Errorf("error importing exec fds: %v", err)
+	}
+	procArgs.FDMap = fdm
+
+	tg, _, err := s.k.CreateProcess(procArgs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to exec process: %v", err)
+	}
+
+	if args.StdioIsPty && tty != nil {
+		tty.InitForegroundProcessGroup(tg.ProcessGroup())
+	}
+
+	return int32(tg.Leader().ID()), nil
+}
+
+// Signal delivers a signal to a single PID, or to the foreground process
+// group of the container's TTY session when ForegroundProcessGroup is set.
+func (s *Server) Signal(sig Signal) error {
+	if sig.ForegroundProcessGroup {
+		return s.k.SendContainerSignal("sbox", linux.Signal(sig.Signo))
+	}
+	tg := s.k.TaskSet().Root.ThreadGroupWithID(kernel.ThreadID(sig.PID))
+	if tg == nil {
+		return fmt.Errorf("no such process: %d", sig.PID)
+	}
+	return tg.SendSignal(&linux.SignalInfo{Signo: sig.Signo})
+}
+
+// Wait blocks until pid exits and returns its exit status.
+func (s *Server) Wait(pid int32) (int32, error) {
+	tg := s.k.TaskSet().Root.ThreadGroupWithID(kernel.ThreadID(pid))
+	if tg == nil {
+		return 0, fmt.Errorf("no such process: %d", pid)
+	}
+	tg.WaitExited()
+	return int32(tg.ExitStatus().Code()), nil
+}
+
+// Processes lists the thread groups currently running in the sandbox.
+func (s *Server) Processes() ([]ProcessInfo, error) {
+	var infos []ProcessInfo
+	for _, tg := range s.k.TaskSet().Root.ThreadGroups() {
+		leader := tg.Leader()
+		// The global init task, and any task whose parent has already
+		// exited and been reaped, has a nil Parent().
+		var ppid int32
+		if p := leader.Parent(); p != nil {
+			ppid = int32(p.ID())
+		}
+		infos = append(infos, ProcessInfo{
+			PID:   int32(leader.ID()),
+			PPID:  ppid,
+			State: leader.StateStatus(),
+		})
+	}
+	return infos, nil
+}
+
+// importStdio imports files as the sandbox process's stdio FDs, sharing a
+// single TTY file across all three when asTTY is set, as createFDMap does
+// for the initial process.
+func importStdio(ctx context.Context, k *kernel.Kernel, l *limits.LimitSet, asTTY bool, files []*os.File) (*kernel.FDMap, *host.TTYFileOperations, error) {
+	fdm := k.NewFDMap()
+	defer fdm.DecRef()
+	mounter := fs.FileOwnerFromContext(ctx)
+
+	var ttyFile *fs.File
+	var ttyfop *host.TTYFileOperations
+	for appFD, f := range files {
+		var appFile *fs.File
+		if asTTY {
+			if ttyFile == nil {
+				var err error
+				appFile, err = host.ImportFile(ctx, int(f.Fd()), mounter, true /* isTTY */)
+				if err != nil {
+					return nil, nil, err
+				}
+				defer appFile.DecRef()
+				ttyFile = appFile
+				ttyfop = appFile.FileOperations.(*host.TTYFileOperations)
+			} else {
+				appFile = ttyFile
+			}
+		} else {
+			var err error
+			appFile, err = host.ImportFile(ctx, int(f.Fd()), mounter, false /* isTTY */)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer appFile.DecRef()
+		}
+		if err := fdm.NewFDAt(kdefs.FD(appFD), appFile, kernel.FDFlags{}, l); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fdm.IncRef()
+	return fdm, ttyfop, nil
+}
+
+// importStdioVFS2 is the VFS2 equivalent of importStdio: it imports files as
+// the exec'd process's stdio FDs via hostvfs2.ImportFD, chowning each host
+// FD to creds' UID/GID first, and shares a single TTY file across all three
+// stdio FDs when asTTY is set.
+func importStdioVFS2(ctx context.Context, k *kernel.Kernel, vfsObj *vfs.VirtualFilesystem, l *limits.LimitSet, asTTY bool, creds *auth.Credentials, files []*os.File) (*kernel.FDTable, *hostvfs2.TTYFileDescription, error) {
+	fdTable := k.NewFDTable()
+
+	var ttyFD *hostvfs2.TTYFileDescription
+	var ttyFile *vfs.FileDescription
+	for appFD, f := range files {
+		hostFD := int(f.Fd())
+		if err := syscall.Fchown(hostFD, int(creds.EffectiveKUID), int(creds.EffectiveKGID)); err != nil {
+			return nil, nil, fmt.Errorf("failed to chown exec stdio fd %d: %v", hostFD, err)
+		}
+
+		var fd *vfs.FileDescription
+		if asTTY && ttyFile != nil {
+			fd = ttyFile
+		} else {
+			var err error
+			fd, err = hostvfs2.ImportFD(ctx, vfsObj, hostvfs2.ImportFDOptions{
+				FD:    hostFD,
+				IsTTY: asTTY,
+				UID:   creds.EffectiveKUID,
+				GID:   creds.EffectiveKGID,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			if asTTY {
+				ttyFile = fd
+				if tty, ok := fd.Impl().(*hostvfs2.TTYFileDescription); ok {
+					ttyFD = tty
+				}
+			}
+		}
+		if err := fdTable.NewFDAt(ctx, int32(appFD), fd, kernel.FDFlags{}, l); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return fdTable, ttyFD, nil
+}
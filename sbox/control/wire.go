@@ -0,0 +1,135 @@
+package control
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxFDs bounds how many FDs a single message may carry over SCM_RIGHTS;
+// exec only ever needs stdin, stdout and stderr.
+const maxFDs = 3
+
+// writeRequest writes a length-prefixed JSON request to conn, passing files
+// as ancillary data via SCM_RIGHTS.
+func writeRequest(conn *net.UnixConn, req request, files []*os.File) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var oob []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, f := range files {
+			fds[i] = int(f.Fd())
+		}
+		oob = unix.UnixRights(fds...)
+	}
+
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(payload)))
+
+	_, _, err = conn.WriteMsgUnix(append(hdr[:], payload...), oob, nil)
+	return err
+}
+
+// readRequest reads one length-prefixed JSON request from conn, along with
+// any FDs passed via SCM_RIGHTS.
+func readRequest(conn *net.UnixConn) (request, []*os.File, error) {
+	oob := make([]byte, unix.CmsgSpace(maxFDs*4))
+	buf := make([]byte, 64*1024)
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return request{}, nil, err
+	}
+	if n < 4 {
+		return request{}, nil, fmt.Errorf("short read: %d bytes", n)
+	}
+
+	size := binary.BigEndian.Uint32(buf[:4])
+	if int(size) > n-4 {
+		return request{}, nil, fmt.Errorf("truncated message: want %d, have %d", size, n-4)
+	}
+
+	var req request
+	if err := json.Unmarshal(buf[4:4+size], &req); err != nil {
+		return request{}, nil, err
+	}
+
+	files, err := filesFromOOB(oob[:oobn])
+	if err != nil {
+		return request{}, nil, err
+	}
+	return req, files, nil
+}
+
+// writeResponse writes a length-prefixed JSON response to conn.
+func writeResponse(conn *net.UnixConn, resp response) error {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(payload)))
+	_, err = conn.Write(append(hdr[:], payload...))
+	return err
+}
+
+// readResponse reads one length-prefixed JSON response from conn.
+func readResponse(conn *net.UnixConn) (response, error) {
+	r := bufio.NewReader(conn)
+	var hdr [4]byte
+	if _, err := readFull(r, hdr[:]); err != nil {
+		return response{}, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	payload := make([]byte, size)
+	if _, err := readFull(r, payload); err != nil {
+		return response{}, err
+	}
+	var resp response
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return response{}, err
+	}
+	return resp, nil
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := r.Read(buf[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func filesFromOOB(oob []byte) ([]*os.File, error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for _, msg := range msgs {
+		fds, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			return nil, err
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "control-fd"))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,53 @@
+package sbox
+
+import (
+	"fmt"
+
+	_ "gvisor.googlesource.com/gvisor/pkg/sentry/fs/gofer"
+)
+
+// defaultMsize is the default p9 message size used for gofer mounts when a
+// mount doesn't request one explicitly via a "msize=" option.
+const defaultMsize = 1 << 20 // 1MB, matching runsc's default.
+
+// goferData builds the gofer filesystem's mount data string for a 9P
+// connection handed over fd, as runsc does when it separates the sandbox
+// from its gofer for defense in depth.
+func goferData(fd int, opts []string) (string, error) {
+	msize := defaultMsize
+	for _, opt := range opts {
+		k, v, ok := splitOption(opt)
+		if !ok {
+			// Flag options (ro, noexec, ...) are validated and applied
+			// by parseMountOptions, not passed as gofer data.
+			continue
+		}
+		if k != "msize" {
+			return "", fmt.Errorf("unsupported gofer mount option %q", k)
+		}
+		if _, err := fmt.Sscanf(v, "%d", &msize); err != nil {
+			return "", fmt.Errorf("invalid msize %q: %v", v, err)
+		}
+	}
+	return fmt.Sprintf("trans=fd,rfdno=%d,wfdno=%d,privateunixsocket=true,msize=%d", fd, fd, msize), nil
+}
+
+// goferFDPool hands out the next available gofer socket FD for each "gofer"
+// or "9p" mount, in the order they appear in the mount list.
+type goferFDPool struct {
+	fds []int
+	i   int
+}
+
+func newGoferFDPool(fds []int) *goferFDPool {
+	return &goferFDPool{fds: fds}
+}
+
+func (p *goferFDPool) next() (int, error) {
+	if p == nil || p.i >= len(p.fds) {
+		return 0, fmt.Errorf("no gofer FD available for mount")
+	}
+	fd := p.fds[p.i]
+	p.i++
+	return fd, nil
+}
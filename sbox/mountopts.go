@@ -0,0 +1,79 @@
+package sbox
+
+import (
+	"fmt"
+	"strings"
+
+	"gvisor.googlesource.com/gvisor/pkg/sentry/fs"
+)
+
+// tmpfsAllowedData mirrors gVisor's tmpfs filesystem: these are the only
+// data options it understands, the rest are rejected rather than silently
+// ignored.
+var tmpfsAllowedData = map[string]bool{
+	"mode": true,
+	"uid":  true,
+	"gid":  true,
+	"size": true,
+}
+
+// mountFlags is the result of parsing a mountSpec's Options: the
+// fs.MountSourceFlags to apply, the data string to hand to the
+// filesystem's Mount method, and whether this mount opted out of the
+// automatic upper-tmpfs overlay.
+type mountFlags struct {
+	source    fs.MountSourceFlags
+	data      string
+	noOverlay bool
+}
+
+// parseMountOptions interprets a mountSpec's Options for fsType, validating
+// them against what that filesystem actually supports.
+func parseMountOptions(fsType string, opts []string) (mountFlags, error) {
+	var mf mountFlags
+	var data []string
+
+	for _, opt := range opts {
+		switch opt {
+		case "ro":
+			mf.source.ReadOnly = true
+		case "rw":
+			mf.source.ReadOnly = false
+		case "noexec":
+			mf.source.NoExec = true
+		case "nosuid", "nodev":
+			// The sentry does not honor setuid bits or device
+			// nodes regardless, so these are accepted as no-ops
+			// for OCI-bundle compatibility.
+		case "no-overlay":
+			mf.noOverlay = true
+		default:
+			k, v, ok := splitOption(opt)
+			if !ok {
+				return mountFlags{}, fmt.Errorf("unrecognized mount option %q", opt)
+			}
+			if (fsType == "gofer" || fsType == "9p") && k == "msize" {
+				// Consumed separately by goferData.
+				continue
+			}
+			if fsType != "tmpfs" {
+				return mountFlags{}, fmt.Errorf("data option %q is only valid for tmpfs mounts", opt)
+			}
+			if !tmpfsAllowedData[k] {
+				return mountFlags{}, fmt.Errorf("unsupported tmpfs data option %q", k)
+			}
+			data = append(data, k+"="+v)
+		}
+	}
+
+	mf.data = strings.Join(data, ",")
+	return mf, nil
+}
+
+func splitOption(opt string) (key, value string, ok bool) {
+	i := strings.IndexByte(opt, '=')
+	if i < 0 {
+		return "", "", false
+	}
+	return opt[:i], opt[i+1:], true
+}
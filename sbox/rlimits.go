@@ -0,0 +1,149 @@
+package sbox
+
+import (
+	"fmt"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/tiborvass/vzor/sbox/authz"
+	"gvisor.googlesource.com/gvisor/pkg/abi/linux"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.googlesource.com/gvisor/pkg/sentry/limits"
+)
+
+// rlimitNames maps the OCI spec's RLIMIT_* names to gVisor's internal
+// limits.LimitType, so Opt.Rlimits can use the same names as a bundle's
+// config.json.
+var rlimitNames = map[string]limits.LimitType{
+	"RLIMIT_AS":         limits.AS,
+	"RLIMIT_CORE":       limits.Core,
+	"RLIMIT_CPU":        limits.CPU,
+	"RLIMIT_DATA":       limits.Data,
+	"RLIMIT_FSIZE":      limits.FileSize,
+	"RLIMIT_LOCKS":      limits.Locks,
+	"RLIMIT_MEMLOCK":    limits.MemoryLocked,
+	"RLIMIT_MSGQUEUE":   limits.MessageQueueBytes,
+	"RLIMIT_NICE":       limits.Nice,
+	"RLIMIT_NOFILE":     limits.NumberOfFiles,
+	"RLIMIT_NPROC":      limits.ProcessCount,
+	"RLIMIT_RSS":        limits.Rss,
+	"RLIMIT_RTPRIO":     limits.RealTimePriority,
+	"RLIMIT_RTTIME":     limits.RealTimeTimeout,
+	"RLIMIT_SIGPENDING": limits.SignalsPending,
+	"RLIMIT_STACK":      limits.Stack,
+}
+
+// capabilityNames maps the OCI spec's CAP_* capability names to gVisor's
+// internal linux.Capability, so a bundle's process.capabilities can use the
+// same names as a config.json.
+var capabilityNames = map[string]linux.Capability{
+	"CAP_CHOWN":            linux.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":     linux.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":  linux.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":           linux.CAP_FOWNER,
+	"CAP_FSETID":           linux.CAP_FSETID,
+	"CAP_KILL":             linux.CAP_KILL,
+	"CAP_SETGID":           linux.CAP_SETGID,
+	"CAP_SETUID":           linux.CAP_SETUID,
+	"CAP_SETPCAP":          linux.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":  linux.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE": linux.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":    linux.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":        linux.CAP_NET_ADMIN,
+	"CAP_NET_RAW":          linux.CAP_NET_RAW,
+	"CAP_IPC_LOCK":         linux.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":        linux.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":       linux.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":        linux.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":       linux.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":       linux.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":        linux.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":        linux.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":         linux.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":         linux.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":     linux.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":         linux.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":   linux.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":            linux.CAP_MKNOD,
+	"CAP_LEASE":            linux.CAP_LEASE,
+	"CAP_AUDIT_WRITE":      linux.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":    linux.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":          linux.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":     linux.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":        linux.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":           linux.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":       linux.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":    linux.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":       linux.CAP_AUDIT_READ,
+}
+
+// capabilitySetFromNames ORs together the auth.CapabilitySet for each OCI
+// CAP_* name in names, rejecting any name gVisor doesn't recognize rather
+// than silently dropping it.
+func capabilitySetFromNames(names []string) (auth.CapabilitySet, error) {
+	var set auth.CapabilitySet
+	for _, name := range names {
+		c, ok := capabilityNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+		set |= auth.CapabilitySetOf(c)
+	}
+	return set, nil
+}
+
+// specCapabilities builds an auth.TaskCapabilities from an OCI spec's
+// Process.Capabilities, or returns nil if the bundle doesn't set one.
+func specCapabilities(lc *specs.LinuxCapabilities) (*auth.TaskCapabilities, error) {
+	if lc == nil {
+		return nil, nil
+	}
+	bounding, err := capabilitySetFromNames(lc.Bounding)
+	if err != nil {
+		return nil, err
+	}
+	effective, err := capabilitySetFromNames(lc.Effective)
+	if err != nil {
+		return nil, err
+	}
+	inheritable, err := capabilitySetFromNames(lc.Inheritable)
+	if err != nil {
+		return nil, err
+	}
+	permitted, err := capabilitySetFromNames(lc.Permitted)
+	if err != nil {
+		return nil, err
+	}
+	ambient, err := capabilitySetFromNames(lc.Ambient)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.TaskCapabilities{
+		PermittedCaps:   permitted,
+		InheritableCaps: inheritable,
+		EffectiveCaps:   effective,
+		BoundingCaps:    bounding,
+		AmbientCaps:     ambient,
+	}, nil
+}
+
+// applyRlimits overlays rlimits (keyed by OCI RLIMIT_* name) onto ls,
+// rejecting any name that isn't a known rlimit.
+func applyRlimits(ls *limits.LimitSet, rlimits map[string]specs.LinuxRlimit) error {
+	for name, rl := range rlimits {
+		lt, ok := rlimitNames[name]
+		if !ok {
+			return fmt.Errorf("unknown rlimit %q", name)
+		}
+		if err := ls.Set(lt, limits.Limit{Cur: rl.Soft, Max: rl.Hard}, true /* privileged */); err != nil {
+			return fmt.Errorf("invalid rlimit %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateCapabilities rejects any capability set that includes one of
+// authz.ReservedCapabilities.
+func validateCapabilities(caps *auth.TaskCapabilities) error {
+	return authz.ValidateCapabilities(caps)
+}
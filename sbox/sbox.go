@@ -5,8 +5,11 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
+	"syscall"
 
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/tiborvass/vzor/sbox/control"
 	"gvisor.googlesource.com/gvisor/pkg/abi/linux"
 	"gvisor.googlesource.com/gvisor/pkg/cpuid"
 	"gvisor.googlesource.com/gvisor/pkg/log"
@@ -38,6 +41,48 @@ type Opt struct {
 	TTY     bool
 	Mounts  string
 	Args    []string
+
+	// Bundle, if set, is the path to an OCI runtime-spec bundle
+	// directory (containing a config.json) to use instead of Mounts.
+	// The bundle's Root and Mounts become the sandbox root filesystem,
+	// its Process fields fill in Args, Env, Cwd and Rlimits when those
+	// are left unset, and a read-only Root sets ReadOnly.
+	Bundle string
+
+	Env      []string
+	Cwd      string
+	ReadOnly bool
+
+	// ControlSocket, if set, is the path at which to expose a control
+	// socket accepting Exec/Signal/Wait/Processes commands against this
+	// sandbox. See sbox/control.
+	ControlSocket string
+
+	// User is the container's init process user. It has no effect when
+	// Bundle is set, since the bundle's Process.User is used instead.
+	User User
+
+	// GoferFDs holds one already-connected Unix-domain socket FD per
+	// "gofer"/"9p" mount in Mounts/Bundle, in the order those mounts
+	// appear, for mounting a remote rootfs served by a 9P gofer.
+	GoferFDs []int
+
+	// VFS2 selects the VFS2 filesystem backend (pkg/sentry/vfs) instead
+	// of the default VFS1 backend (pkg/sentry/fs). See sbox/vfs2.go.
+	VFS2 bool
+
+	// Rlimits overlays the container process's resource limits, keyed by
+	// the OCI spec's RLIMIT_* names, over gVisor's defaults.
+	Rlimits map[string]specs.LinuxRlimit
+}
+
+// User identifies the container process's credentials, as distinct from the
+// superuser context used to set up the root filesystem.
+type User struct {
+	UID            uint32
+	GID            uint32
+	AdditionalGids []uint32
+	Capabilities   *auth.TaskCapabilities
 }
 
 func Run(o Opt) error {
@@ -89,12 +134,36 @@ func Run(o Opt) error {
 		}
 	}
 
-	creds := auth.NewUserCredentials(
-		auth.KUID(0),
-		auth.KGID(0),
-		nil,
-		nil,
-		auth.NewRootUserNamespace())
+	var bundleSpec *specs.Spec
+	if o.Bundle != "" {
+		bundleSpec, err = loadBundle(o.Bundle)
+		if err != nil {
+			return err
+		}
+	}
+
+	rootUserNS := auth.NewRootUserNamespace()
+	var creds *auth.Credentials
+	if bundleSpec != nil {
+		creds, err = specCredentials(bundleSpec, rootUserNS)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := validateCapabilities(o.User.Capabilities); err != nil {
+			return err
+		}
+		var gids []auth.GID
+		for _, g := range o.User.AdditionalGids {
+			gids = append(gids, auth.GID(g))
+		}
+		creds = auth.NewUserCredentials(
+			auth.KUID(o.User.UID),
+			auth.KGID(o.User.GID),
+			gids,
+			o.User.Capabilities,
+			rootUserNS)
+	}
 
 	if err = k.Init(kernel.InitKernelArgs{
 		FeatureSet:                  cpuid.HostFeatureSet(),
@@ -110,16 +179,37 @@ func Run(o Opt) error {
 		return fmt.Errorf("error initializing kernel: %v", err)
 	}
 
+	mounts := parseMounts(o.Mounts)
+	if bundleSpec != nil {
+		mounts = specMounts(o.Bundle, bundleSpec)
+		specArgs(&o, bundleSpec)
+	}
+
+	if o.VFS2 {
+		return runVFS2(o, k, creds, mounts)
+	}
+	return runVFS1(o, k, creds, mounts)
+}
+
+func runVFS1(o Opt, k *kernel.Kernel, creds *auth.Credentials, mounts []mountSpec) error {
 	ls, err := limits.NewLinuxLimitSet()
 	if err != nil {
 		return err
 	}
+	if err := applyRlimits(ls, o.Rlimits); err != nil {
+		return err
+	}
+
+	cwd := o.Cwd
+	if cwd == "" {
+		cwd = "/"
+	}
 
 	// Create the process arguments.
 	procArgs := kernel.CreateProcessArgs{
 		Argv:                    o.Args,
-		Envv:                    []string{},
-		WorkingDirectory:        "/", // Defaults to '/' if empty.
+		Envv:                    o.Env,
+		WorkingDirectory:        cwd,
 		Credentials:             creds,
 		Umask:                   0022,
 		Limits:                  ls,
@@ -131,7 +221,7 @@ func Run(o Opt) error {
 	}
 	ctx := procArgs.NewContext(k)
 
-	fdm, err := createFDMap(ctx, k, ls, o.TTY, []int{0, 1, 2})
+	fdm, err := createFDMap(ctx, k, ls, o.TTY, creds, []int{0, 1, 2})
 	if err != nil {
 		return fmt.Errorf("error importing fds: %v", err)
 	}
@@ -150,7 +240,7 @@ func Run(o Opt) error {
 	mns := k.RootMountNamespace()
 	if mns == nil {
 		followLinks := uint(linux.MaxSymlinkTraversals)
-		mns, err := createMountNamespace(ctx, rootCtx, strings.Split(o.Mounts, ","), &followLinks)
+		mns, err := createMountNamespace(ctx, rootCtx, mounts, o.ReadOnly, o.GoferFDs, &followLinks)
 		if err != nil {
 			return fmt.Errorf("error creating mounts: %v", err)
 		}
@@ -161,6 +251,16 @@ func Run(o Opt) error {
 		return fmt.Errorf("failed to create init process: %v", err)
 	}
 
+	if o.ControlSocket != "" {
+		srv := control.New(k, k.RootMountNamespace(), nil, nil, nil, o.ControlSocket)
+		go func() {
+			if err := srv.Serve(); err != nil {
+				log.Warningf("control socket %s stopped serving: %v", o.ControlSocket, err)
+			}
+		}()
+		defer srv.Close()
+	}
+
 	tg := k.GlobalInit()
 	if o.TTY {
 		ttyFile := procArgs.FDMap.GetFile(0)
@@ -196,8 +296,9 @@ func addSubmountOverlay(ctx context.Context, inode *fs.Inode, submounts []string
 	return overlayInode, err
 }
 
-func createMountNamespace(userCtx context.Context, rootCtx context.Context, mounts []string, maxTraversals *uint) (*fs.MountNamespace, error) {
-	rootInode, err := createRootMount(rootCtx, mounts)
+func createMountNamespace(userCtx context.Context, rootCtx context.Context, mounts []mountSpec, readOnly bool, goferFDs []int, maxTraversals *uint) (*fs.MountNamespace, error) {
+	gofers := newGoferFDPool(goferFDs)
+	rootInode, err := createRootMount(rootCtx, mounts, readOnly, gofers)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create root mount: %v", err)
 	}
@@ -209,35 +310,124 @@ func createMountNamespace(userCtx context.Context, rootCtx context.Context, moun
 
 	root := mns.Root()
 	defer root.DecRef()
+	ctx := rootCtx
 
-	proc, ok := fs.FindFilesystem("proc")
+	submounts := nonRootMounts(mounts)
+	if len(submounts) == 0 {
+		// Legacy behavior: always give the sandbox a /proc.
+		submounts = []mountSpec{{Type: "proc", Destination: "/proc"}}
+	}
+	for _, m := range submounts {
+		if err := mountAt(ctx, mns, root, m, gofers, maxTraversals); err != nil {
+			return nil, err
+		}
+	}
+
+	return mns, nil
+}
+
+// nonRootMounts returns the mounts with an explicit Destination other than
+// the root, i.e. the ones that need mounting into the namespace above and
+// beyond the root filesystem itself.
+func nonRootMounts(mounts []mountSpec) []mountSpec {
+	var out []mountSpec
+	for _, m := range mounts {
+		if m.Destination != "" && m.Destination != "/" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// mountAt mounts m's filesystem type at m.Destination within mns.
+func mountAt(ctx context.Context, mns *fs.MountNamespace, root *fs.Dirent, m mountSpec, gofers *goferFDPool, maxTraversals *uint) error {
+	fsName, err := rootFilesystemFor(m.Type)
+	if err != nil {
+		return err
+	}
+	filesystem, ok := fs.FindFilesystem(fsName)
 	if !ok {
-		panic(fmt.Sprintf("could not find filesystem proc"))
+		panic(fmt.Sprintf("could not find filesystem %s", fsName))
 	}
-	ctx := rootCtx
-	inode, err := proc.Mount(ctx, "none", fs.MountSourceFlags{}, "", nil)
+
+	mf, err := parseMountOptions(fsName, m.Options)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create mount with source: %v", err)
+		return fmt.Errorf("invalid options for mount at %s: %v", m.Destination, err)
 	}
 
-	dirent, err := mns.FindInode(ctx, root, root, "/proc", maxTraversals)
+	var inode *fs.Inode
+	switch fsName {
+	case "whitelistfs":
+		src := m.Source
+		if !filepath.IsAbs(src) {
+			wd, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			src = filepath.Join(wd, src)
+		}
+		inode, err = filesystem.Mount(ctx, "", mf.source, "root="+src, nil)
+	case "gofer":
+		fd, ferr := gofers.next()
+		if ferr != nil {
+			return ferr
+		}
+		data, derr := goferData(fd, m.Options)
+		if derr != nil {
+			return derr
+		}
+		inode, err = filesystem.Mount(ctx, "/", mf.source, data, nil)
+	default:
+		source := m.Source
+		if source == "" {
+			source = "none"
+		}
+		inode, err = filesystem.Mount(ctx, source, mf.source, mf.data, nil)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to find mount destination: %v", err)
+		return fmt.Errorf("failed to create mount with source: %v", err)
+	}
+
+	dirent, err := mns.FindInode(ctx, root, root, m.Destination, maxTraversals)
+	if err != nil {
+		return fmt.Errorf("failed to find mount destination: %v", err)
 	}
 	defer dirent.DecRef()
 	if err := mns.Mount(ctx, dirent, inode); err != nil {
-		return nil, fmt.Errorf("failed to mount at destination: %v", err)
+		return fmt.Errorf("failed to mount at destination: %v", err)
 	}
-
-	return mns, nil
+	return nil
 }
 
-func createRootMount(ctx context.Context, mounts []string) (*fs.Inode, error) {
-	// First construct the filesystem from the spec.Root.
-	mf := fs.MountSourceFlags{ReadOnly: false}
+// rootFilesystemFor maps a mountSpec's Type to the gVisor filesystem driver
+// that should serve it. An empty Type (an OCI mount that sets no type) is
+// treated like "bind": a host path bind-mounted via whitelistfs.
+func rootFilesystemFor(t string) (string, error) {
+	switch t {
+	case "", "bind":
+		return "whitelistfs", nil
+	case "tmpfs":
+		return "tmpfs", nil
+	case "proc":
+		return "proc", nil
+	case "sysfs":
+		return "sys", nil
+	case "devtmpfs":
+		return "dev", nil
+	case "devpts":
+		return "tty", nil
+	case "gofer", "9p":
+		return "gofer", nil
+	default:
+		return "", fmt.Errorf("unsupported mount type %q", t)
+	}
+}
 
+func createRootMount(ctx context.Context, mounts []mountSpec, readOnly bool, gofers *goferFDPool) (*fs.Inode, error) {
 	var (
 		rootInode, prevInode *fs.Inode
+		submounts            []mountSpec
+		noOverlay            bool
 		err                  error
 	)
 
@@ -246,16 +436,55 @@ func createRootMount(ctx context.Context, mounts []string) (*fs.Inode, error) {
 		return nil, err
 	}
 
-	host, ok := fs.FindFilesystem("whitelistfs")
-	if !ok {
-		panic(fmt.Sprintf("could not find filesystem host"))
-	}
-	for i, m := range mounts {
-		if !filepath.IsAbs(m) {
-			m = filepath.Join(wd, m)
+	i := 0
+	for _, m := range mounts {
+		// Non-root mounts (those with an explicit Destination) are
+		// applied as submounts once the root is assembled, below.
+		if m.Destination != "" && m.Destination != "/" {
+			submounts = append(submounts, m)
+			continue
+		}
+		fsName, ferr := rootFilesystemFor(m.Type)
+		if ferr != nil {
+			return nil, ferr
+		}
+		filesystem, ok := fs.FindFilesystem(fsName)
+		if !ok {
+			panic(fmt.Sprintf("could not find filesystem %s", fsName))
+		}
+		mf, err := parseMountOptions(fsName, m.Options)
+		if err != nil {
+			return nil, fmt.Errorf("invalid options for root mount %s: %v", m.Source, err)
+		}
+		mf.source.ReadOnly = mf.source.ReadOnly || readOnly
+		if mf.noOverlay {
+			noOverlay = true
+		}
+
+		switch fsName {
+		case "gofer":
+			fd, ferr := gofers.next()
+			if ferr != nil {
+				return nil, ferr
+			}
+			data, derr := goferData(fd, m.Options)
+			if derr != nil {
+				return nil, derr
+			}
+			rootInode, err = filesystem.Mount(ctx, "/", mf.source, data, nil)
+		case "whitelistfs":
+			src := m.Source
+			if !filepath.IsAbs(src) {
+				src = filepath.Join(wd, src)
+			}
+			rootInode, err = filesystem.Mount(ctx, "", mf.source, "root="+src, nil)
+		default:
+			source := m.Source
+			if source == "" {
+				source = "none"
+			}
+			rootInode, err = filesystem.Mount(ctx, source, mf.source, mf.data, nil)
 		}
-		// fmt.Println("root=" + m)
-		rootInode, err = host.Mount(ctx, "", mf, "root="+m, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate root mount point: %v", err)
 		}
@@ -266,12 +495,31 @@ func createRootMount(ctx context.Context, mounts []string) (*fs.Inode, error) {
 			}
 		}
 		prevInode = rootInode
+		i++
 	}
 
-	submounts := []string{"/dev", "/sys", "/proc", "/tmp"}
-	rootInode, err = addSubmountOverlay(ctx, rootInode, submounts)
-	if err != nil {
-		return nil, fmt.Errorf("error adding submount overlay: %v", err)
+	if len(submounts) == 0 {
+		// No explicit submounts were given (the legacy path): fall
+		// back to the default /dev, /sys, /proc and /tmp tree.
+		rootInode, err = addSubmountOverlay(ctx, rootInode, []string{"/dev", "/sys", "/proc", "/tmp"})
+		if err != nil {
+			return nil, fmt.Errorf("error adding submount overlay: %v", err)
+		}
+	} else {
+		paths := make([]string, 0, len(submounts))
+		for _, m := range submounts {
+			paths = append(paths, m.Destination)
+		}
+		rootInode, err = addSubmountOverlay(ctx, rootInode, paths)
+		if err != nil {
+			return nil, fmt.Errorf("error adding submount overlay: %v", err)
+		}
+	}
+
+	if noOverlay {
+		// A root mount asked to opt out of the automatic upper-tmpfs
+		// overlay, so it can be truly read-write against the host.
+		return rootInode, nil
 	}
 
 	tmpfs, ok := fs.FindFilesystem("tmpfs")
@@ -291,7 +539,7 @@ func createRootMount(ctx context.Context, mounts []string) (*fs.Inode, error) {
 	return rootInode, nil
 }
 
-func createFDMap(ctx context.Context, k *kernel.Kernel, l *limits.LimitSet, console bool, stdioFDs []int) (*kernel.FDMap, error) {
+func createFDMap(ctx context.Context, k *kernel.Kernel, l *limits.LimitSet, console bool, creds *auth.Credentials, stdioFDs []int) (*kernel.FDMap, error) {
 	if len(stdioFDs) != 3 {
 		return nil, fmt.Errorf("stdioFDs should contain exactly 3 FDs (stdin, stdout, and stderr), but %d FDs received", len(stdioFDs))
 	}
@@ -307,6 +555,17 @@ func createFDMap(ctx context.Context, k *kernel.Kernel, l *limits.LimitSet, cons
 		2: stdioFDs[2],
 	}
 
+	uid := int(creds.EffectiveKUID)
+	gid := int(creds.EffectiveKGID)
+	for _, hostFD := range fdMap {
+		// Chown the host FD before importing it, so that a non-root
+		// container user can actually read/write its stdio (see
+		// gVisor issue #6180).
+		if err := syscall.Fchown(hostFD, uid, gid); err != nil {
+			log.Warningf("failed to chown stdio fd %d to %d:%d: %v", hostFD, uid, gid, err)
+		}
+	}
+
 	var ttyFile *fs.File
 	for appFD, hostFD := range fdMap {
 		var appFile *fs.File